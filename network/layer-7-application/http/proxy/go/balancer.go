@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backend 代表负载均衡池里的一个上游地址，记录它当前是否健康、
+// 正在处理的连接数，以及用于被动摘除的近期错误计数。
+type Backend struct {
+	URL *url.URL
+
+	mu             sync.Mutex
+	healthy        bool
+	consecSuccess  int
+	consecFailures int
+
+	activeConns int64
+
+	failMu     sync.Mutex
+	failWindow []time.Time
+}
+
+func newBackend(rawURL string) (*Backend, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &Backend{URL: u, healthy: true}, nil
+}
+
+// Healthy 返回这个 backend 当前是否被认为可用。
+func (b *Backend) Healthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.healthy
+}
+
+// recordProbe 记录一次主动健康检查的结果，连续成功/失败达到阈值后
+// 才翻转健康状态，避免单次抖动就把 backend 摘掉或拉回来。
+func (b *Backend) recordProbe(ok bool, healthyThreshold, unhealthyThreshold int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ok {
+		b.consecSuccess++
+		b.consecFailures = 0
+		if !b.healthy && b.consecSuccess >= healthyThreshold {
+			b.healthy = true
+		}
+	} else {
+		b.consecFailures++
+		b.consecSuccess = 0
+		if b.healthy && b.consecFailures >= unhealthyThreshold {
+			b.healthy = false
+		}
+	}
+}
+
+// recordPassiveError 记录一次来自真实请求的 5xx/连接错误，在
+// window 时间窗口内累计到 threshold 次就把 backend 摘除，直到
+// 下一次主动健康检查把它探活。
+func (b *Backend) recordPassiveError(window time.Duration, threshold int) {
+	now := time.Now()
+
+	b.failMu.Lock()
+	b.failWindow = append(b.failWindow, now)
+	cutoff := now.Add(-window)
+	i := 0
+	for ; i < len(b.failWindow); i++ {
+		if b.failWindow[i].After(cutoff) {
+			break
+		}
+	}
+	b.failWindow = b.failWindow[i:]
+	count := len(b.failWindow)
+	b.failMu.Unlock()
+
+	if count >= threshold {
+		b.mu.Lock()
+		b.healthy = false
+		b.consecFailures = threshold
+		b.mu.Unlock()
+	}
+}
+
+func (b *Backend) incConns() { atomic.AddInt64(&b.activeConns, 1) }
+func (b *Backend) decConns() { atomic.AddInt64(&b.activeConns, -1) }
+func (b *Backend) conns() int64 { return atomic.LoadInt64(&b.activeConns) }
+
+// Balancer 从一组健康的 backend 里为请求挑选一个。实现只会拿到
+// 已经过滤出的健康 backend 列表，不需要自己再判断健康状态。
+type Balancer interface {
+	Next(req *http.Request, healthy []*Backend) *Backend
+}
+
+// BalancerFunc 让普通函数满足 Balancer 接口。
+type BalancerFunc func(req *http.Request, healthy []*Backend) *Backend
+
+func (f BalancerFunc) Next(req *http.Request, healthy []*Backend) *Backend {
+	return f(req, healthy)
+}
+
+// RoundRobinBalancer 按顺序依次把请求分发给每个健康 backend。
+func RoundRobinBalancer() Balancer {
+	var counter uint64
+	return BalancerFunc(func(req *http.Request, healthy []*Backend) *Backend {
+		if len(healthy) == 0 {
+			return nil
+		}
+		n := atomic.AddUint64(&counter, 1)
+		return healthy[int(n)%len(healthy)]
+	})
+}
+
+// RandomBalancer 在健康 backend 里均匀随机选择一个。
+func RandomBalancer() Balancer {
+	return BalancerFunc(func(req *http.Request, healthy []*Backend) *Backend {
+		if len(healthy) == 0 {
+			return nil
+		}
+		return healthy[pseudoRandomIndex(len(healthy))]
+	})
+}
+
+// pseudoRandomIndex 用当前时间的纳秒数做一个足够均匀的随机源，
+// 避免仅为了负载均衡引入 math/rand 的全局状态和种子管理。
+func pseudoRandomIndex(n int) int {
+	if n <= 1 {
+		return 0
+	}
+	return int(time.Now().UnixNano()) % n
+}
+
+// LeastConnBalancer 选择当前处理中请求数最少的 backend。
+func LeastConnBalancer() Balancer {
+	return BalancerFunc(func(req *http.Request, healthy []*Backend) *Backend {
+		if len(healthy) == 0 {
+			return nil
+		}
+		best := healthy[0]
+		for _, b := range healthy[1:] {
+			if b.conns() < best.conns() {
+				best = b
+			}
+		}
+		return best
+	})
+}
+
+// consistentHashVirtualNodes 是每个 backend 在哈希环上映射的虚拟节点
+// 数。数量越多，key 在 backend 间分布越均匀，但构建哈希环的开销也越大。
+const consistentHashVirtualNodes = 100
+
+// ConsistentHashBalancer 按请求头 header 的值做一致性哈希，保证同一个
+// header 值（比如用户 ID、session ID）总是落到同一个 backend 上。和对
+// 排序后的 backend 列表取模不同，这里用真正的哈希环（每个 backend 映射
+// 多个虚拟节点），backend 集合发生变化时只有环上相邻的一小部分 key 会
+// 被重新映射，不会因为健康检查摘除/恢复一个 backend 就让几乎所有 key
+// 都换到别的 backend 上。
+func ConsistentHashBalancer(header string) Balancer {
+	return BalancerFunc(func(req *http.Request, healthy []*Backend) *Backend {
+		if len(healthy) == 0 {
+			return nil
+		}
+		key := req.Header.Get(header)
+		if key == "" {
+			key = req.RemoteAddr
+		}
+		return hashRingPick(healthy, key)
+	})
+}
+
+// ringPoint 是哈希环上的一个点：某个 backend 的一个虚拟节点。
+type ringPoint struct {
+	hash    uint32
+	backend *Backend
+}
+
+// hashRingPick 为 healthy 构建一个哈希环（按 backend 数 ×
+// consistentHashVirtualNodes 个点），再顺时针找到第一个哈希值不小于
+// key 哈希值的点，返回它所属的 backend；环上没有这样的点时绕回第一个。
+// 每次请求都重新构建环，换取实现的简单和正确——healthy 集合本来就是
+// 调用方每次传入的快照，没有地方缓存它不发生变化。
+func hashRingPick(healthy []*Backend, key string) *Backend {
+	ring := make([]ringPoint, 0, len(healthy)*consistentHashVirtualNodes)
+	for _, b := range healthy {
+		for v := 0; v < consistentHashVirtualNodes; v++ {
+			ring = append(ring, ringPoint{hash: fnv32(b.URL.String() + "#" + strconv.Itoa(v)), backend: b})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+
+	h := fnv32(key)
+	idx := sort.Search(len(ring), func(i int) bool {
+		return ring[i].hash >= h
+	})
+	if idx == len(ring) {
+		idx = 0
+	}
+	return ring[idx].backend
+}
+
+func fnv32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// backendStatus 是 /-/status 返回的单个 backend 状态快照。
+type backendStatus struct {
+	URL         string `json:"url"`
+	Healthy     bool   `json:"healthy"`
+	ActiveConns int64  `json:"active_conns"`
+}
+
+// StatusHandler 返回一个 HTTP handler，以 JSON 形式报告当前所有
+// backend 的健康状态，供人工或监控探测 /-/status 使用。
+func (p *ProxyServer) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		statuses := make([]backendStatus, 0, len(p.backends))
+		for _, b := range p.backends {
+			statuses = append(statuses, backendStatus{
+				URL:         b.URL.String(),
+				Healthy:     b.Healthy(),
+				ActiveConns: b.conns(),
+			})
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(statuses)
+	})
+}
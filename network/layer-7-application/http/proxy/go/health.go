@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// healthChecker 周期性地探测一组 backend 的 healthCheckPath，
+// 根据连续成功/失败次数翻转每个 backend 的健康状态。
+type healthChecker struct {
+	backends           []*Backend
+	path               string
+	interval           time.Duration
+	timeout            time.Duration
+	healthyThreshold   int
+	unhealthyThreshold int
+
+	client *http.Client
+	stop   chan struct{}
+}
+
+func newHealthChecker(backends []*Backend, path string, interval, timeout time.Duration, healthyThreshold, unhealthyThreshold int) *healthChecker {
+	return &healthChecker{
+		backends:           backends,
+		path:               path,
+		interval:           interval,
+		timeout:            timeout,
+		healthyThreshold:   healthyThreshold,
+		unhealthyThreshold: unhealthyThreshold,
+		client:             &http.Client{Timeout: timeout},
+		stop:               make(chan struct{}),
+	}
+}
+
+// run 在调用者的 goroutine 里循环探测，直到 Stop 被调用。
+func (h *healthChecker) run() {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			h.probeAll()
+		}
+	}
+}
+
+func (h *healthChecker) probeAll() {
+	for _, b := range h.backends {
+		ok := h.probe(b)
+		b.recordProbe(ok, h.healthyThreshold, h.unhealthyThreshold)
+	}
+}
+
+func (h *healthChecker) probe(b *Backend) bool {
+	checkURL := *b.URL
+	checkURL.Path = h.path
+
+	resp, err := h.client.Get(checkURL.String())
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+// Stop 终止健康检查循环。
+func (h *healthChecker) Stop() {
+	close(h.stop)
+}
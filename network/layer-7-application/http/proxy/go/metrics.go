@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultLatencyBuckets 是延迟直方图的桶边界（秒），覆盖从毫秒级到
+// 几秒的典型反向代理延迟分布。
+var defaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram 是一个简单的累积桶直方图，实现 Prometheus 的 histogram 语义
+// （每个桶计数是 <= 该桶上界的观测值总数）。
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(seconds float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.sum += seconds
+	h.count++
+	for i, bound := range h.buckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+}
+
+func (h *histogram) snapshot() (buckets []float64, counts []uint64, sum float64, count uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]float64(nil), h.buckets...), append([]uint64(nil), h.counts...), h.sum, h.count
+}
+
+// MetricsRegistry 收集跨整个 server 集群的请求指标：正在处理的请求数、
+// 按路由分桶的延迟直方图，以及按上游分类的错误计数，并以 Prometheus
+// 文本暴露格式输出。
+type MetricsRegistry struct {
+	inFlight int64
+
+	mu         sync.Mutex
+	histograms map[string]*histogram
+
+	upstreamErrors sync.Map // backend string -> *int64
+}
+
+// NewMetricsRegistry 创建一个空的指标注册表。
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{histograms: make(map[string]*histogram)}
+}
+
+func (r *MetricsRegistry) histogramFor(route string) *histogram {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h, ok := r.histograms[route]
+	if !ok {
+		h = newHistogram(defaultLatencyBuckets)
+		r.histograms[route] = h
+	}
+	return h
+}
+
+// ObserveLatency 记录一次请求的耗时，按 route 分桶。
+func (r *MetricsRegistry) ObserveLatency(route string, d time.Duration) {
+	r.histogramFor(route).observe(d.Seconds())
+}
+
+// IncInFlight/DecInFlight 维护当前正在处理的请求数。
+func (r *MetricsRegistry) IncInFlight() { atomic.AddInt64(&r.inFlight, 1) }
+func (r *MetricsRegistry) DecInFlight() { atomic.AddInt64(&r.inFlight, -1) }
+
+// IncUpstreamError 记录一次到某个上游的错误（5xx、连接失败等）。
+func (r *MetricsRegistry) IncUpstreamError(backend string) {
+	v, _ := r.upstreamErrors.LoadOrStore(backend, new(int64))
+	atomic.AddInt64(v.(*int64), 1)
+}
+
+// MetricsMiddleware 在请求处理前后记录 in-flight 计数和按 route 分桶的
+// 延迟，route 通常传路由的路径前缀或模板，避免基数爆炸。
+func MetricsMiddleware(reg *MetricsRegistry, route string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			reg.IncInFlight()
+			defer reg.DecInFlight()
+
+			start := time.Now()
+			next.ServeHTTP(rw, req)
+			reg.ObserveLatency(route, time.Since(start))
+		})
+	}
+}
+
+// Handler 返回一个输出 Prometheus 文本暴露格式的 /metrics handler。
+func (r *MetricsRegistry) Handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.writeTo(rw)
+	})
+}
+
+func (r *MetricsRegistry) writeTo(w io.Writer) {
+	fmt.Fprintln(w, "# HELP proxy_in_flight_requests Number of requests currently being processed.")
+	fmt.Fprintln(w, "# TYPE proxy_in_flight_requests gauge")
+	fmt.Fprintf(w, "proxy_in_flight_requests %d\n", atomic.LoadInt64(&r.inFlight))
+
+	fmt.Fprintln(w, "# HELP proxy_request_duration_seconds Request latency by route.")
+	fmt.Fprintln(w, "# TYPE proxy_request_duration_seconds histogram")
+
+	r.mu.Lock()
+	routes := make([]string, 0, len(r.histograms))
+	for route := range r.histograms {
+		routes = append(routes, route)
+	}
+	r.mu.Unlock()
+	sort.Strings(routes)
+
+	for _, route := range routes {
+		buckets, counts, sum, count := r.histogramFor(route).snapshot()
+		for i, bound := range buckets {
+			fmt.Fprintf(w, "proxy_request_duration_seconds_bucket{route=%q,le=\"%g\"} %d\n", route, bound, counts[i])
+		}
+		fmt.Fprintf(w, "proxy_request_duration_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", route, count)
+		fmt.Fprintf(w, "proxy_request_duration_seconds_sum{route=%q} %g\n", route, sum)
+		fmt.Fprintf(w, "proxy_request_duration_seconds_count{route=%q} %d\n", route, count)
+	}
+
+	fmt.Fprintln(w, "# HELP proxy_upstream_errors_total Upstream errors seen by the proxy, by backend.")
+	fmt.Fprintln(w, "# TYPE proxy_upstream_errors_total counter")
+	r.upstreamErrors.Range(func(key, value any) bool {
+		fmt.Fprintf(w, "proxy_upstream_errors_total{backend=%q} %d\n", key.(string), atomic.LoadInt64(value.(*int64)))
+		return true
+	})
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loadMITMFromEnv 在环境变量 MITM_CA_CERT/MITM_CA_KEY 都指向可读文件时
+// 构造一个 MITM 拦截器，否则返回 ok=false——这样 MITM 模式是可选的，
+// 不需要每次运行 demo 都准备一张 CA 证书。
+func loadMITMFromEnv() (*MITM, bool) {
+	certPath := os.Getenv("MITM_CA_CERT")
+	keyPath := os.Getenv("MITM_CA_KEY")
+	if certPath == "" || keyPath == "" {
+		return nil, false
+	}
+
+	ca, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		log.Printf("加载 MITM CA 证书失败: %v", err)
+		return nil, false
+	}
+
+	mitm := NewMITM(ca, 1024)
+	mitm.OnResponse(ContentTypeIs("application/json")).Do(func(resp *http.Response) *http.Response {
+		resp.Header.Set("X-Mitm-Inspected", "json")
+		return resp
+	})
+	return mitm, true
+}
+
+// RequestFilter 判断一个解密后的 HTTPS 请求是否应该交给对应的
+// RequestHandler 处理。
+type RequestFilter func(req *http.Request) bool
+
+// ResponseFilter 判断一个上游响应是否应该交给对应的 ResponseHandler 处理。
+type ResponseFilter func(req *http.Request, resp *http.Response) bool
+
+// RequestHandler 可以就地检查/修改被拦截的请求，返回值作为继续处理的请求
+// （通常就是传入的 req 本身，修改后返回）。
+type RequestHandler func(req *http.Request) *http.Request
+
+// ResponseHandler 可以就地检查/修改上游响应，返回值作为最终返回给客户端
+// 的响应（通常就是传入的 resp 本身，修改后返回）。
+type ResponseHandler func(resp *http.Response) *http.Response
+
+// HostMatches 构造一个按 Host（正则）匹配的 RequestFilter。
+func HostMatches(pattern *regexp.Regexp) RequestFilter {
+	return func(req *http.Request) bool {
+		return pattern.MatchString(req.Host)
+	}
+}
+
+// ContentTypeIs 构造一个按响应 Content-Type 前缀匹配的 ResponseFilter。
+func ContentTypeIs(mime string) ResponseFilter {
+	return func(req *http.Request, resp *http.Response) bool {
+		return strings.HasPrefix(resp.Header.Get("Content-Type"), mime)
+	}
+}
+
+type requestHook struct {
+	filter  RequestFilter
+	handler RequestHandler
+}
+
+type responseHook struct {
+	filter  ResponseFilter
+	handler ResponseHandler
+}
+
+// requestHookBuilder 是 MITM.OnRequest(...) 返回的中间对象，调用 Do
+// 才会真正把 handler 注册上去——这样调用点读起来像
+// `mitm.OnRequest(HostMatches(re)).Do(handler)`。
+type requestHookBuilder struct {
+	mitm    *MITM
+	filters []RequestFilter
+}
+
+func (b *requestHookBuilder) Do(handler RequestHandler) {
+	b.mitm.mu.Lock()
+	defer b.mitm.mu.Unlock()
+	b.mitm.requestHooks = append(b.mitm.requestHooks, requestHook{filter: combineRequestFilters(b.filters), handler: handler})
+}
+
+type responseHookBuilder struct {
+	mitm    *MITM
+	filters []ResponseFilter
+}
+
+func (b *responseHookBuilder) Do(handler ResponseHandler) {
+	b.mitm.mu.Lock()
+	defer b.mitm.mu.Unlock()
+	b.mitm.responseHooks = append(b.mitm.responseHooks, responseHook{filter: combineResponseFilters(b.filters), handler: handler})
+}
+
+func combineRequestFilters(filters []RequestFilter) RequestFilter {
+	return func(req *http.Request) bool {
+		for _, f := range filters {
+			if !f(req) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func combineResponseFilters(filters []ResponseFilter) ResponseFilter {
+	return func(req *http.Request, resp *http.Response) bool {
+		for _, f := range filters {
+			if !f(req, resp) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// MITM 实现拦截模式：收到 CONNECT 之后，用 ca 签发一张覆盖目标 host 的
+// 叶子证书，在本地终止 TLS，再把解密后的明文请求交给 OnRequest/OnResponse
+// 注册的 hook 检查或修改，然后用 http.Transport 发往真实上游。
+type MITM struct {
+	ca        tls.Certificate
+	certCache *certCache
+	transport *http.Transport
+
+	mu            sync.Mutex
+	requestHooks  []requestHook
+	responseHooks []responseHook
+}
+
+// NewMITM 创建一个 MITM 拦截器，ca 是用来给每个被拦截的 host 签发叶子证书
+// 的根证书（必须包含私钥）。cacheSize 控制 LRU 缓存的叶子证书数量，避免
+// 每个请求都重新签名。
+func NewMITM(ca tls.Certificate, cacheSize int) *MITM {
+	return &MITM{
+		ca:        ca,
+		certCache: newCertCache(cacheSize),
+		transport: &http.Transport{},
+	}
+}
+
+// OnRequest 注册一组过滤器，满足全部过滤器的请求会交给后续 Do 注册的 handler。
+func (m *MITM) OnRequest(filters ...RequestFilter) *requestHookBuilder {
+	return &requestHookBuilder{mitm: m, filters: filters}
+}
+
+// OnResponse 注册一组过滤器，满足全部过滤器的响应会交给后续 Do 注册的 handler。
+func (m *MITM) OnResponse(filters ...ResponseFilter) *responseHookBuilder {
+	return &responseHookBuilder{mitm: m, filters: filters}
+}
+
+// intercept 处理一个 CONNECT 请求：劫持底层连接、完成 TLS 握手、
+// 循环读取明文请求并转发，直到连接关闭。
+func (m *MITM) intercept(rw http.ResponseWriter, req *http.Request) {
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		http.Error(rw, "不支持 CONNECT", http.StatusInternalServerError)
+		return
+	}
+
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("MITM hijack 失败: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		log.Printf("MITM 写入 200 失败: %v", err)
+		return
+	}
+
+	host := req.URL.Hostname()
+	if host == "" {
+		host, _, _ = net.SplitHostPort(req.Host)
+	}
+	if host == "" {
+		host = req.Host
+	}
+
+	cert, err := m.certCache.certFor(host, m.ca)
+	if err != nil {
+		log.Printf("MITM 为 %s 签发证书失败: %v", host, err)
+		return
+	}
+
+	tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{*cert}})
+	defer tlsConn.Close()
+
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("MITM TLS 握手失败(%s): %v", host, err)
+		return
+	}
+
+	reader := bufio.NewReader(tlsConn)
+	for {
+		plainReq, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		plainReq.URL.Scheme = "https"
+		plainReq.URL.Host = plainReq.Host
+
+		m.mu.Lock()
+		reqHooks := append([]requestHook(nil), m.requestHooks...)
+		respHooks := append([]responseHook(nil), m.responseHooks...)
+		m.mu.Unlock()
+
+		for _, h := range reqHooks {
+			if h.filter == nil || h.filter(plainReq) {
+				plainReq = h.handler(plainReq)
+			}
+		}
+
+		resp, err := m.transport.RoundTrip(plainReq)
+		if err != nil {
+			log.Printf("MITM 转发到 %s 失败: %v", plainReq.URL, err)
+			return
+		}
+
+		for _, h := range respHooks {
+			if h.filter == nil || h.filter(plainReq, resp) {
+				resp = h.handler(resp)
+			}
+		}
+
+		if err := resp.Write(tlsConn); err != nil {
+			resp.Body.Close()
+			return
+		}
+		resp.Body.Close()
+	}
+}
+
+// certCache 是一个按 host 做 key、容量有限的叶子证书 LRU 缓存，避免
+// 每个请求都重新对证书签名。
+type certCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type certCacheEntry struct {
+	host string
+	cert *tls.Certificate
+}
+
+func newCertCache(capacity int) *certCache {
+	if capacity <= 0 {
+		capacity = 256
+	}
+	return &certCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// certFor 返回 host 对应的叶子证书，命中缓存直接返回，否则用 ca 现签一张。
+func (c *certCache) certFor(host string, ca tls.Certificate) (*tls.Certificate, error) {
+	c.mu.Lock()
+	if el, ok := c.items[host]; ok {
+		c.ll.MoveToFront(el)
+		cert := el.Value.(*certCacheEntry).cert
+		c.mu.Unlock()
+		return cert, nil
+	}
+	c.mu.Unlock()
+
+	cert, err := generateLeafCert(host, ca)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	el := c.ll.PushFront(&certCacheEntry{host: host, cert: cert})
+	c.items[host] = el
+	for c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*certCacheEntry).host)
+	}
+	c.mu.Unlock()
+
+	return cert, nil
+}
+
+// generateLeafCert 现场生成一张以 host 为 CN/SAN、由 ca 签名的叶子证书。
+func generateLeafCert(host string, ca tls.Certificate) (*tls.Certificate, error) {
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{host},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.Certificate[0]},
+		PrivateKey:  key,
+	}, nil
+}
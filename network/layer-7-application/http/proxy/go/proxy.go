@@ -1,386 +1,697 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
-	"os/signal"
+	"regexp"
+	"strings"
 	"sync"
-	"syscall"
 	"time"
 )
 
-// 代理服务器结构
-type ProxyServer struct {
-	targetURL *url.URL
-	proxy     *httputil.ReverseProxy
-}
+// Middleware 包裹一个 http.Handler，返回包裹后的 http.Handler，
+// 用来在请求到达真正的业务逻辑（这里是反向代理）之前/之后做统一处理。
+type Middleware func(http.Handler) http.Handler
 
-// 创建新的代理服务器
-func NewProxyServer(targetURL string) (*ProxyServer, error) {
-	url, err := url.Parse(targetURL)
-	if err != nil {
-		return nil, err
+// chain 按顺序把中间件应用到 final 上：mws[0] 最外层先执行，
+// 然后一路往内层走，最后才轮到 final。
+func chain(final http.Handler, mws ...Middleware) http.Handler {
+	h := final
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
 	}
+	return h
+}
 
-	// 创建反向代理
-	proxy := httputil.NewSingleHostReverseProxy(url)
+// statusCapturingWriter 包装 http.ResponseWriter 以记录状态码和写入的字节数，
+// 同时转发 Hijacker/Flusher，使 WebSocket 升级和 SSE 这类流式响应在经过
+// 中间件链时仍然可用。
+type statusCapturingWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
 
-	// 自定义请求修改器（可选）
-	proxy.ModifyResponse = func(resp *http.Response) error {
-		// 可以在这里修改响应头
-		resp.Header.Set("X-Proxy-By", "Go-Proxy-Server")
-		return nil
+func (w *statusCapturingWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
 	}
+	w.status = status
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
 
-	// 错误处理器
-	proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
-		log.Printf("代理错误: %v", err)
-		rw.WriteHeader(http.StatusBadGateway)
-		rw.Write([]byte("代理服务器错误"))
+func (w *statusCapturingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
 	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
 
-	return &ProxyServer{
-		targetURL: url,
-		proxy:     proxy,
-	}, nil
+func (w *statusCapturingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("底层 ResponseWriter 不支持 Hijack")
+	}
+	return hj.Hijack()
 }
 
-// 处理HTTP请求
-func (p *ProxyServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	// 记录请求信息
-	log.Printf("代理请求: %s %s -> %s", req.Method, req.URL.Path, p.targetURL.String())
+func (w *statusCapturingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
 
-	// 可以在这里添加请求预处理逻辑
-	// 例如：添加认证头、修改请求路径等
+// AccessLogMiddleware 以 Apache combined log format 把每个请求写到 out，
+// 字段包括客户端地址、方法、路径、状态码、响应字节数、耗时、UA 和 Referer。
+func AccessLogMiddleware(out io.Writer) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			sw := &statusCapturingWriter{ResponseWriter: rw, status: http.StatusOK}
+
+			next.ServeHTTP(sw, req)
+
+			duration := time.Since(start)
+			referer := req.Referer()
+			if referer == "" {
+				referer = "-"
+			}
+			ua := req.UserAgent()
+			if ua == "" {
+				ua = "-"
+			}
+			fmt.Fprintf(out, "%s - - [%s] \"%s %s %s\" %d %d \"%s\" \"%s\" %s\n",
+				req.RemoteAddr,
+				start.Format("02/Jan/2006:15:04:05 -0700"),
+				req.Method, req.URL.RequestURI(), req.Proto,
+				sw.status, sw.bytes,
+				referer, ua, duration,
+			)
+		})
+	}
+}
 
-	// 转发请求
-	p.proxy.ServeHTTP(rw, req)
+// BasicAuthMiddleware 要求请求携带 HTTP Basic Auth，用户名/密码需要出现在
+// creds（用户名 -> 密码）中，否则返回 401。
+func BasicAuthMiddleware(creds map[string]string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			user, pass, ok := req.BasicAuth()
+			if !ok || creds[user] != pass {
+				rw.Header().Set("WWW-Authenticate", `Basic realm="restricted"`)
+				http.Error(rw, "未授权", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}
 }
 
-// 带有路径映射的代理服务器
-type MultiProxyServer struct {
-	routes map[string]*ProxyServer
+// BearerAuthMiddleware 要求请求携带 `Authorization: Bearer <token>`，
+// token 需要出现在 validTokens 中，否则返回 401。
+func BearerAuthMiddleware(validTokens map[string]bool) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			authz := req.Header.Get("Authorization")
+			token, ok := strings.CutPrefix(authz, "Bearer ")
+			if !ok || !validTokens[token] {
+				http.Error(rw, "未授权", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}
 }
 
-// 创建多路由代理服务器
-func NewMultiProxyServer() *MultiProxyServer {
-	return &MultiProxyServer{
-		routes: make(map[string]*ProxyServer),
+// tokenBucket 是一个简单的令牌桶限流器：按 refillRate（每秒令牌数）连续
+// 补充令牌，最多积累到 capacity 个。
+type tokenBucket struct {
+	mu         sync.Mutex
+	tokens     float64
+	capacity   float64
+	refillRate float64 // 每秒补充的令牌数
+	lastRefill time.Time
+}
+
+func newTokenBucket(capacity float64, refillRate float64) *tokenBucket {
+	return &tokenBucket{
+		tokens:     capacity,
+		capacity:   capacity,
+		refillRate: refillRate,
+		lastRefill: time.Now(),
 	}
 }
 
-// 添加路由
-func (m *MultiProxyServer) AddRoute(path string, targetURL string) error {
-	proxy, err := NewProxyServer(targetURL)
-	if err != nil {
-		return err
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(b.lastRefill).Seconds()
+	b.lastRefill = now
+
+	b.tokens += elapsed * b.refillRate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
 	}
-	m.routes[path] = proxy
-	return nil
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
 }
 
-// 处理请求
-func (m *MultiProxyServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	// 根据路径选择目标服务器
-	for path, proxy := range m.routes {
-		if len(req.URL.Path) >= len(path) && req.URL.Path[:len(path)] == path {
-			// 移除路径前缀（可选）
-			// req.URL.Path = req.URL.Path[len(path):]
-			proxy.ServeHTTP(rw, req)
-			return
+// RateLimitMiddleware 按客户端 IP 做令牌桶限流，capacity 是桶容量，
+// refillPerSecond 是每秒补充的令牌数。
+func RateLimitMiddleware(capacity float64, refillPerSecond float64) Middleware {
+	var mu sync.Mutex
+	buckets := make(map[string]*tokenBucket)
+
+	bucketFor := func(key string) *tokenBucket {
+		mu.Lock()
+		defer mu.Unlock()
+		b, ok := buckets[key]
+		if !ok {
+			b = newTokenBucket(capacity, refillPerSecond)
+			buckets[key] = b
 		}
+		return b
 	}
 
-	// 没有匹配的路由
-	http.NotFound(rw, req)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			key := clientIP(req)
+			if !bucketFor(key).allow() {
+				http.Error(rw, "请求过于频繁", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}
 }
 
-// 目标服务器1 (端口8081)
-func startTargetServer1(ctx context.Context, wg *sync.WaitGroup) {
-	defer wg.Done()
+// clientIP 提取客户端 IP，优先使用 RemoteAddr 的 host 部分。
+func clientIP(req *http.Request) string {
+	host := req.RemoteAddr
+	if idx := strings.LastIndex(host, ":"); idx >= 0 {
+		host = host[:idx]
+	}
+	return host
+}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "来自服务器1的响应 - 路径: %s\n时间: %s\n", r.URL.Path, time.Now().Format("2006-01-02 15:04:05"))
-	})
+// CORSMiddleware 添加跨域相关响应头，allowedOrigins 为空时表示允许所有来源。
+func CORSMiddleware(allowedOrigins []string) Middleware {
+	allowAll := len(allowedOrigins) == 0
+	allowed := make(map[string]bool, len(allowedOrigins))
+	for _, o := range allowedOrigins {
+		allowed[o] = true
+	}
 
-	server := &http.Server{
-		Addr:    ":8081",
-		Handler: mux,
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			origin := req.Header.Get("Origin")
+			if origin != "" && (allowAll || allowed[origin]) {
+				rw.Header().Set("Access-Control-Allow-Origin", origin)
+				rw.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+				rw.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			}
+
+			if req.Method == http.MethodOptions {
+				rw.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			next.ServeHTTP(rw, req)
+		})
 	}
+}
 
-	// 在goroutine中启动服务器
-	go func() {
-		log.Println("目标服务器1启动在端口8081")
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Printf("目标服务器1错误: %v", err)
-		}
-	}()
+// gzipResponseWriter 包装 http.ResponseWriter，把写入的内容经过 gzip
+// 压缩后再输出，并转发 Hijacker/Flusher 以兼容流式响应。
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
 
-	// 等待关闭信号
-	<-ctx.Done()
-	log.Println("正在关闭目标服务器1...")
+// WriteHeader 在响应头真正写出之前删掉 Content-Length：反向代理
+// 会在 next.ServeHTTP 内部把上游未压缩响应的
+// Content-Length 拷贝过来，早于这次调用删一次并不能阻止它被重新设置，
+// 所以要在这里、写 header 的最后时刻再删一次，否则客户端会按未压缩的
+// 长度截断 gzip 之后的响应体。
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(status)
+}
 
-	// 优雅关闭
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	return w.gz.Write(b)
+}
 
-	if err := server.Shutdown(shutdownCtx); err != nil {
-		log.Printf("目标服务器1关闭错误: %v", err)
-	} else {
-		log.Println("目标服务器1已关闭")
+func (w *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("底层 ResponseWriter 不支持 Hijack")
 	}
+	return hj.Hijack()
 }
 
-// 目标服务器2 (端口8082)
-func startTargetServer2(ctx context.Context, wg *sync.WaitGroup) {
-	defer wg.Done()
+func (w *gzipResponseWriter) Flush() {
+	w.gz.Flush()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "来自服务器2(静态资源)的响应 - 路径: %s\n时间: %s\n", r.URL.Path, time.Now().Format("2006-01-02 15:04:05"))
-	})
+// GzipMiddleware 在客户端通过 Accept-Encoding 声明支持 gzip 时压缩响应体。
+func GzipMiddleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if !strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+				next.ServeHTTP(rw, req)
+				return
+			}
+
+			rw.Header().Set("Content-Encoding", "gzip")
 
-	server := &http.Server{
-		Addr:    ":8082",
-		Handler: mux,
+			gz := gzip.NewWriter(rw)
+			defer gz.Close()
+
+			next.ServeHTTP(&gzipResponseWriter{ResponseWriter: rw, gz: gz}, req)
+		})
 	}
+}
 
-	go func() {
-		log.Println("目标服务器2启动在端口8082")
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Printf("目标服务器2错误: %v", err)
-		}
-	}()
+// backendKey 是挂在请求 context 上的 key，记录本次请求选中的 backend，
+// 好让 Director/ErrorHandler 在不共享可变状态的前提下知道转发到哪。
+type backendKey struct{}
 
-	<-ctx.Done()
-	log.Println("正在关闭目标服务器2...")
+// Option 配置 NewProxyServer 创建出来的 ProxyServer。
+type Option func(*ProxyServer)
 
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// WithBalancerOption 指定在多个 backend 间选择目标的策略，默认是
+// RoundRobinBalancer。
+func WithBalancerOption(b Balancer) Option {
+	return func(p *ProxyServer) {
+		p.balancer = b
+	}
+}
 
-	if err := server.Shutdown(shutdownCtx); err != nil {
-		log.Printf("目标服务器2关闭错误: %v", err)
-	} else {
-		log.Println("目标服务器2已关闭")
+// WithHealthCheck 开启主动健康检查：周期性地探测每个 backend 的
+// healthPath，连续 unhealthyThreshold 次失败就摘除，连续
+// healthyThreshold 次成功就恢复。
+func WithHealthCheck(healthPath string, interval, timeout time.Duration, healthyThreshold, unhealthyThreshold int) Option {
+	return func(p *ProxyServer) {
+		p.healthCheckPath = healthPath
+		p.healthCheckInterval = interval
+		p.healthCheckTimeout = timeout
+		p.healthyThreshold = healthyThreshold
+		p.unhealthyThreshold = unhealthyThreshold
 	}
 }
 
-// 目标服务器3 (端口8083)
-func startTargetServer3(ctx context.Context, wg *sync.WaitGroup) {
-	defer wg.Done()
+// WithPassiveEjection 配置被动摘除：代理在 window 时间窗口内看到同一个
+// backend 累计 threshold 次 5xx 响应（ModifyResponse 记录）或连接错误
+// （ErrorHandler 记录），就直接摘除它，不必等下一次主动健康检查。
+// 被动摘除默认开启（10 秒内 5 次）；threshold <= 0 时关闭。
+func WithPassiveEjection(window time.Duration, threshold int) Option {
+	return func(p *ProxyServer) {
+		p.passiveFailWindow = window
+		p.passiveFailThreshold = threshold
+	}
+}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "来自服务器3(默认服务)的响应 - 路径: %s\n时间: %s\n", r.URL.Path, time.Now().Format("2006-01-02 15:04:05"))
-	})
+// WithMetrics 把代理错误计入 reg 的 upstream 错误计数器，按 backend 地址分类。
+func WithMetrics(reg *MetricsRegistry) Option {
+	return func(p *ProxyServer) {
+		p.metrics = reg
+	}
+}
 
-	server := &http.Server{
-		Addr:    ":8083",
-		Handler: mux,
+// WithMITM 开启针对 CONNECT 请求的中间人拦截模式：客户端发起 CONNECT 时，
+// 不再直接做 TCP 层面的穿透，而是由 m 生成证书终止 TLS，并把解密后的请求
+// 交给 m 上注册的 OnRequest/OnResponse hook 处理。
+func WithMITM(m *MITM) Option {
+	return func(p *ProxyServer) {
+		p.mitm = m
 	}
+}
+
+// 代理服务器结构：持有一个 backend 池，每个请求经 balancer 选出一个
+// backend 后再转发，取代原来只认单一 httputil.NewSingleHostReverseProxy
+// 目标的做法。
+type ProxyServer struct {
+	backends []*Backend
+	balancer Balancer
+	proxy    *httputil.ReverseProxy
+
+	middleware []Middleware
+
+	healthCheckPath      string
+	healthCheckInterval  time.Duration
+	healthCheckTimeout   time.Duration
+	healthyThreshold     int
+	unhealthyThreshold   int
+	passiveFailWindow    time.Duration
+	passiveFailThreshold int
+	checker              *healthChecker
+	metrics              *MetricsRegistry
+	mitm                 *MITM
+}
 
-	go func() {
-		log.Println("目标服务器3启动在端口8083")
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Printf("目标服务器3错误: %v", err)
+// 创建新的代理服务器，targets 是上游地址池。
+func NewProxyServer(targets []string, opts ...Option) (*ProxyServer, error) {
+	backends := make([]*Backend, 0, len(targets))
+	for _, t := range targets {
+		b, err := newBackend(t)
+		if err != nil {
+			return nil, err
 		}
-	}()
+		backends = append(backends, b)
+	}
+
+	p := &ProxyServer{
+		backends:             backends,
+		balancer:             RoundRobinBalancer(),
+		passiveFailWindow:    10 * time.Second,
+		passiveFailThreshold: 5,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
 
-	<-ctx.Done()
-	log.Println("正在关闭目标服务器3...")
+	p.proxy = &httputil.ReverseProxy{
+		Director: p.director,
+		ModifyResponse: func(resp *http.Response) error {
+			// 可以在这里修改响应头
+			resp.Header.Set("X-Proxy-By", "Go-Proxy-Server")
+
+			// 5xx 也算一次被动故障，和连接错误一起计入同一个失败窗口；
+			// 这里不把它转成 error 返回（那样会让 ErrorHandler 用一个
+			// 通用 502 页面替换掉 backend 真实返回的响应体），只是单纯
+			// 记一次失败，原始响应仍然原样转发给客户端。
+			if resp.StatusCode >= http.StatusInternalServerError {
+				if backend, ok := resp.Request.Context().Value(backendKey{}).(*Backend); ok {
+					if p.passiveFailThreshold > 0 {
+						backend.recordPassiveError(p.passiveFailWindow, p.passiveFailThreshold)
+					}
+					if p.metrics != nil {
+						p.metrics.IncUpstreamError(backend.URL.String())
+					}
+				}
+			}
+
+			return nil
+		},
+		ErrorHandler: p.handleProxyError,
+	}
 
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	if p.healthCheckPath != "" {
+		p.checker = newHealthChecker(backends, p.healthCheckPath, p.healthCheckInterval, p.healthCheckTimeout, p.healthyThreshold, p.unhealthyThreshold)
+		go p.checker.run()
+	}
 
-	if err := server.Shutdown(shutdownCtx); err != nil {
-		log.Printf("目标服务器3关闭错误: %v", err)
+	return p, nil
+}
+
+// director 按 backend 池重写请求的 scheme/host/path，等价于
+// httputil.NewSingleHostReverseProxy 对单一目标做的事情，只是目标
+// 是从 context 里选出来的那个 backend。
+func (p *ProxyServer) director(req *http.Request) {
+	backend, _ := req.Context().Value(backendKey{}).(*Backend)
+	if backend == nil {
+		return
+	}
+
+	target := backend.URL
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	req.URL.Path, req.URL.RawPath = joinURLPath(target, req.URL)
+	if target.RawQuery == "" || req.URL.RawQuery == "" {
+		req.URL.RawQuery = target.RawQuery + req.URL.RawQuery
 	} else {
-		log.Println("目标服务器3已关闭")
+		req.URL.RawQuery = target.RawQuery + "&" + req.URL.RawQuery
+	}
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header.Set("User-Agent", "")
 	}
 }
 
-// 启动代理服务器
-func startProxyServer(ctx context.Context, wg *sync.WaitGroup) {
-	defer wg.Done()
+func joinURLPath(a *url.URL, b *url.URL) (path, rawpath string) {
+	if a.RawPath == "" && b.RawPath == "" {
+		return singleJoiningSlash(a.Path, b.Path), ""
+	}
+	apath := a.EscapedPath()
+	bpath := b.EscapedPath()
+	return singleJoiningSlash(a.Path, b.Path), singleJoiningSlash(apath, bpath)
+}
 
-	// 等待目标服务器启动
-	time.Sleep(2 * time.Second)
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
 
-	// 方式1: 单一目标代理
-	fmt.Println("=== 单一目标代理示例 ===")
-	singleProxy, err := NewProxyServer("http://localhost:8081")
-	if err != nil {
-		log.Fatal("创建代理失败:", err)
+// handleProxyError 处理反向代理转发失败的情况：记一次被动故障，
+// 达到阈值就摘除出健康列表，同时给客户端返回 502。
+func (p *ProxyServer) handleProxyError(rw http.ResponseWriter, req *http.Request, err error) {
+	log.Printf("代理错误: %v", err)
+
+	if backend, ok := req.Context().Value(backendKey{}).(*Backend); ok {
+		if p.passiveFailThreshold > 0 {
+			backend.recordPassiveError(p.passiveFailWindow, p.passiveFailThreshold)
+		}
+		if p.metrics != nil {
+			p.metrics.IncUpstreamError(backend.URL.String())
+		}
 	}
 
-	// 方式2: 多目标代理
-	fmt.Println("=== 多目标代理示例 ===")
-	multiProxy := NewMultiProxyServer()
-	multiProxy.AddRoute("/api", "http://localhost:8081")
-	multiProxy.AddRoute("/static", "http://localhost:8082")
-	multiProxy.AddRoute("/", "http://localhost:8083") // 默认路由
+	rw.WriteHeader(http.StatusBadGateway)
+	rw.Write([]byte("代理服务器错误"))
+}
 
-	// 启动代理服务器
-	mux := http.NewServeMux()
+// Use 追加全局中间件，按调用顺序包裹请求处理链。
+func (p *ProxyServer) Use(mw ...Middleware) {
+	p.middleware = append(p.middleware, mw...)
+}
 
-	// 单一代理路由
-	mux.Handle("/single/", http.StripPrefix("/single", singleProxy))
+// 处理HTTP请求
+func (p *ProxyServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	chain(http.HandlerFunc(p.serveProxied), p.middleware...).ServeHTTP(rw, req)
+}
 
-	// 多目标代理路由
-	mux.Handle("/", multiProxy)
+// healthyBackends 返回当前健康的 backend 列表。
+func (p *ProxyServer) healthyBackends() []*Backend {
+	healthy := make([]*Backend, 0, len(p.backends))
+	for _, b := range p.backends {
+		if b.Healthy() {
+			healthy = append(healthy, b)
+		}
+	}
+	return healthy
+}
 
-	// 创建HTTP服务器
-	server := &http.Server{
-		Addr:         ":8080",
-		Handler:      mux,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
+// serveProxied 是中间件链的终点：CONNECT 请求在开启了 MITM 时交给拦截器，
+// 否则按正常流程选一个健康 backend，记录请求信息，再转发到上游。
+func (p *ProxyServer) serveProxied(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodConnect && p.mitm != nil {
+		p.mitm.intercept(rw, req)
+		return
 	}
 
-	go func() {
-		fmt.Println("代理服务器启动在端口 8080")
-		fmt.Println("单一代理: http://localhost:8080/single/")
-		fmt.Println("多目标代理:")
-		fmt.Println("  /api -> http://localhost:8081")
-		fmt.Println("  /static -> http://localhost:8082")
-		fmt.Println("  / -> http://localhost:8083")
-		fmt.Println("\n测试URL:")
-		fmt.Println("  http://localhost:8080/api/test")
-		fmt.Println("  http://localhost:8080/static/css/style.css")
-		fmt.Println("  http://localhost:8080/home")
-		fmt.Println("  http://localhost:8080/single/target1/test")
-
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Printf("代理服务器错误: %v", err)
-		}
-	}()
+	backend := p.balancer.Next(req, p.healthyBackends())
+	if backend == nil {
+		http.Error(rw, "没有可用的上游服务器", http.StatusServiceUnavailable)
+		return
+	}
 
-	<-ctx.Done()
-	log.Println("正在关闭代理服务器...")
+	log.Printf("代理请求: %s %s -> %s", req.Method, req.URL.Path, backend.URL.String())
 
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	backend.incConns()
+	defer backend.decConns()
 
-	if err := server.Shutdown(shutdownCtx); err != nil {
-		log.Printf("代理服务器关闭错误: %v", err)
-	} else {
-		log.Println("代理服务器已关闭")
+	req = req.WithContext(context.WithValue(req.Context(), backendKey{}, backend))
+	p.proxy.ServeHTTP(rw, req)
+}
+
+// RouteOption 配置 MultiProxyServer.AddRoute/AddRouteHost 添加的单条路由。
+type RouteOption func(*routeEntry)
+
+// WithRouteMiddleware 给这条路由追加只在命中该路由时生效的中间件。
+func WithRouteMiddleware(mw ...Middleware) RouteOption {
+	return func(r *routeEntry) {
+		r.middleware = append(r.middleware, mw...)
 	}
 }
 
-// 简单版本 - 同时启动所有服务器
-func mainSimple() {
-	var wg sync.WaitGroup
+// WithStripPrefix 在转发前从请求路径里去掉给定前缀。
+func WithStripPrefix(prefix string) RouteOption {
+	return func(r *routeEntry) {
+		r.stripPrefix = prefix
+	}
+}
 
-	// 启动目标服务器
-	wg.Add(1)
-	go startTargetServer1Simple(&wg)
+// WithAddPrefix 在转发前给请求路径加上给定前缀。
+func WithAddPrefix(prefix string) RouteOption {
+	return func(r *routeEntry) {
+		r.addPrefix = prefix
+	}
+}
 
-	wg.Add(1)
-	go startTargetServer2Simple(&wg)
+// WithRewrite 在转发前用正则 pattern 把路径替换成 replace
+// （replace 里可以用 "$1" 这样的分组引用）。
+func WithRewrite(pattern *regexp.Regexp, replace string) RouteOption {
+	return func(r *routeEntry) {
+		r.rewritePattern = pattern
+		r.rewriteReplace = replace
+	}
+}
 
-	wg.Add(1)
-	go startTargetServer3Simple(&wg)
+// 带有路径映射的代理服务器。底层使用 router（radix trie）做最长前缀
+// 匹配，取代原来对 map 做线性扫描、谁先命中用谁的做法——map 的遍历
+// 顺序在 Go 里本来就是不确定的，多条前缀重叠的路由会导致结果不可预测。
+type MultiProxyServer struct {
+	mu         sync.RWMutex
+	router     *router
+	middleware []Middleware
+}
 
-	// 启动代理服务器
-	wg.Add(1)
-	go startProxyServerSimple(&wg)
+// 创建多路由代理服务器
+func NewMultiProxyServer() *MultiProxyServer {
+	return &MultiProxyServer{
+		router: newRouter(),
+	}
+}
 
-	// 等待所有服务器
-	wg.Wait()
+// Use 追加作用于所有路由的全局中间件。
+func (m *MultiProxyServer) Use(mw ...Middleware) {
+	m.middleware = append(m.middleware, mw...)
 }
 
-// 简单版本的目标服务器函数
-func startTargetServer1Simple(wg *sync.WaitGroup) {
-	defer wg.Done()
+// AddRoute 添加一条对所有 host 都生效的路由，path 支持 ":name" 参数
+// 分段和 "*name" 通配分段（用来捕获路径剩余部分）。
+func (m *MultiProxyServer) AddRoute(path string, targetURL string, opts ...RouteOption) error {
+	return m.AddRouteHost("", path, targetURL, opts...)
+}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "来自服务器1的响应 - 路径: %s\n时间: %s\n", r.URL.Path, time.Now().Format("2006-01-02 15:04:05"))
-	})
+// AddRouteHost 添加一条只在请求 Host 等于 host 时才生效的路由；
+// host 为空字符串时等价于 AddRoute，对所有 host 生效。
+func (m *MultiProxyServer) AddRouteHost(host, path string, targetURL string, opts ...RouteOption) error {
+	proxy, err := NewProxyServer([]string{targetURL})
+	if err != nil {
+		return err
+	}
 
-	log.Println("目标服务器1启动在端口8081")
-	server := &http.Server{
-		Addr:    ":8081",
-		Handler: mux,
+	entry := &routeEntry{proxy: proxy}
+	for _, opt := range opts {
+		opt(entry)
 	}
-	log.Fatal(server.ListenAndServe())
-}
 
-func startTargetServer2Simple(wg *sync.WaitGroup) {
-	defer wg.Done()
+	m.mu.Lock()
+	m.router.add(host, path, entry)
+	m.mu.Unlock()
+	return nil
+}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "来自服务器2(静态资源)的响应 - 路径: %s\n时间: %s\n", r.URL.Path, time.Now().Format("2006-01-02 15:04:05"))
-	})
+// 处理请求
+func (m *MultiProxyServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	chain(http.HandlerFunc(m.serveMatched), m.middleware...).ServeHTTP(rw, req)
+}
 
-	log.Println("目标服务器2启动在端口8082")
-	server := &http.Server{
-		Addr:    ":8082",
-		Handler: mux,
+// serveMatched 按 host+path 做最长前缀匹配选出目标服务器，按配置改写
+// 路径，再套上该路由专属的中间件转发出去；没有匹配到任何路由（包括
+// 兜底的 "/"）时才会返回 404。
+func (m *MultiProxyServer) serveMatched(rw http.ResponseWriter, req *http.Request) {
+	m.mu.RLock()
+	entry, params := m.router.match(req.Host, req.URL.Path)
+	m.mu.RUnlock()
+
+	if entry == nil {
+		http.NotFound(rw, req)
+		return
 	}
-	log.Fatal(server.ListenAndServe())
-}
 
-func startTargetServer3Simple(wg *sync.WaitGroup) {
-	defer wg.Done()
+	req = withParams(req, params)
+	req.URL.Path = entry.rewrite(req.URL.Path)
 
+	chain(entry.proxy, entry.middleware...).ServeHTTP(rw, req)
+}
+
+// newTargetHandler 构造一个目标服务器的 handler，name/port 只用于响应文本，
+// 三个目标服务器（8081/8082/8083）共用同一套逻辑。
+func newTargetHandler(name string) http.Handler {
 	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "来自服务器3(默认服务)的响应 - 路径: %s\n时间: %s\n", r.URL.Path, time.Now().Format("2006-01-02 15:04:05"))
+		fmt.Fprintf(w, "来自%s的响应 - 路径: %s\n时间: %s\n", name, r.URL.Path, time.Now().Format("2006-01-02 15:04:05"))
 	})
-
-	log.Println("目标服务器3启动在端口8083")
-	server := &http.Server{
-		Addr:    ":8083",
-		Handler: mux,
-	}
-	log.Fatal(server.ListenAndServe())
+	return mux
 }
 
-func startProxyServerSimple(wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	// 等待目标服务器启动
-	time.Sleep(2 * time.Second)
-
+// buildProxyMux 组装单一代理、多目标代理和 /metrics、/-/status 管理端点，
+// 返回挂载完成的 http.ServeMux，供 ServerGroup 托管的代理服务器使用。
+func buildProxyMux(reg *MetricsRegistry) http.Handler {
 	// 方式1: 单一目标代理
 	fmt.Println("=== 单一目标代理示例 ===")
-	singleProxy, err := NewProxyServer("http://localhost:8081")
+	opts := []Option{
+		WithBalancerOption(LeastConnBalancer()),
+		WithHealthCheck("/healthz", 10*time.Second, 2*time.Second, 2, 3),
+		WithMetrics(reg),
+	}
+	if mitm, ok := loadMITMFromEnv(); ok {
+		fmt.Println("=== 已启用 HTTPS 拦截(MITM)模式 ===")
+		opts = append(opts, WithMITM(mitm))
+	}
+	singleProxy, err := NewProxyServer([]string{"http://localhost:8081", "http://localhost:8082"}, opts...)
 	if err != nil {
 		log.Fatal("创建代理失败:", err)
 	}
+	singleProxy.Use(AccessLogMiddleware(os.Stdout), CORSMiddleware(nil), MetricsMiddleware(reg, "single"))
 
 	// 方式2: 多目标代理
 	fmt.Println("=== 多目标代理示例 ===")
 	multiProxy := NewMultiProxyServer()
-	multiProxy.AddRoute("/api", "http://localhost:8081")
+	multiProxy.Use(AccessLogMiddleware(os.Stdout), RateLimitMiddleware(50, 10), MetricsMiddleware(reg, "multi"))
+	multiProxy.AddRoute("/api", "http://localhost:8081", WithRouteMiddleware(GzipMiddleware()))
 	multiProxy.AddRoute("/static", "http://localhost:8082")
 	multiProxy.AddRoute("/", "http://localhost:8083") // 默认路由
 
-	// 启动代理服务器
 	mux := http.NewServeMux()
 
 	// 单一代理路由
 	mux.Handle("/single/", http.StripPrefix("/single", singleProxy))
 
+	// 健康状态查询
+	mux.Handle("/-/status", singleProxy.StatusHandler())
+
+	// Prometheus 风格的运行指标
+	mux.Handle("/metrics", reg.Handler())
+
 	// 多目标代理路由
 	mux.Handle("/", multiProxy)
 
-	// 创建HTTP服务器
-	server := &http.Server{
-		Addr:         ":8080",
-		Handler:      mux,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-	}
+	handler := connectAwareHandler(singleProxy, mux)
 
 	fmt.Println("代理服务器启动在端口 8080")
 	fmt.Println("单一代理: http://localhost:8080/single/")
@@ -394,52 +705,44 @@ func startProxyServerSimple(wg *sync.WaitGroup) {
 	fmt.Println("  http://localhost:8080/home")
 	fmt.Println("  http://localhost:8080/single/target1/test")
 
-	log.Fatal(server.ListenAndServe())
+	return handler
 }
 
-// 优雅关闭版本
-func mainWithGracefulShutdown() {
-	// 创建上下文用于优雅关闭
-	ctx, cancel := context.WithCancel(context.Background())
-
-	// 监听中断信号
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-	// 启动所有服务器
-	var wg sync.WaitGroup
-
-	// 启动目标服务器
-	wg.Add(1)
-	go startTargetServer1(ctx, &wg)
-
-	wg.Add(1)
-	go startTargetServer2(ctx, &wg)
-
-	wg.Add(1)
-	go startTargetServer3(ctx, &wg)
-
-	wg.Add(1)
-	go startProxyServer(ctx, &wg)
+// connectAwareHandler 在 mux 路由之前拦截 CONNECT 请求。CONNECT 请求
+// 是 authority-form（req.URL.Path 为空字符串），http.ServeMux 按路径
+// 前缀匹配，永远不可能命中它，所以 ProxyServer.serveProxied 里的 MITM
+// 分支单靠挂在 mux 上是到不了的；这里把 CONNECT 在 mux 之前直接交给
+// singleProxy（启用 MITM 时拦截器就配置在它上面；未启用时它按普通请求
+// 转发给 backend），其余方法继续走 mux 原来的路由逻辑。
+func connectAwareHandler(mitmProxy http.Handler, mux http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodConnect {
+			mitmProxy.ServeHTTP(rw, req)
+			return
+		}
+		mux.ServeHTTP(rw, req)
+	})
+}
 
-	// 等待中断信号
-	<-sigChan
-	log.Println("收到关闭信号，正在优雅关闭...")
+// 主函数：把目标服务器和代理服务器都交给 ServerGroup 管理，统一按
+// 启动顺序监听、按反序优雅关闭，取代原来 mainSimple 里 log.Fatal(
+// ListenAndServe) 直接跳过关闭流程的做法。
+func main() {
+	reg := NewMetricsRegistry()
 
-	// 取消上下文
-	cancel()
+	group := NewServerGroup(10 * time.Second)
+	group.Add("目标服务器1", &http.Server{Addr: ":8081", Handler: newTargetHandler("服务器1")})
+	group.Add("目标服务器2", &http.Server{Addr: ":8082", Handler: newTargetHandler("服务器2(静态资源)")})
+	group.Add("目标服务器3", &http.Server{Addr: ":8083", Handler: newTargetHandler("服务器3(默认服务)")})
 
-	// 等待所有服务器关闭
-	wg.Wait()
-	log.Println("所有服务器已关闭")
-}
+	group.Add("代理服务器", &http.Server{
+		Addr:         ":8080",
+		Handler:      buildProxyMux(reg),
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	})
 
-// 主函数 - 你可以选择运行简单版本或优雅关闭版本
-func main() {
-	// 选择运行模式
-	if len(os.Args) > 1 && os.Args[1] == "graceful" {
-		mainWithGracefulShutdown()
-	} else {
-		mainSimple()
+	if err := group.Run(context.Background()); err != nil {
+		log.Printf("服务器集群关闭时出现错误: %v", err)
 	}
 }
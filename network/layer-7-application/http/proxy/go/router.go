@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// paramsKey 是挂在请求 context 上的 key，用来取出路由匹配时解析出的
+// path 参数（例如 "/users/:id" 里的 id）。
+type paramsKey struct{}
+
+// RouteParams 返回从请求 URL 匹配到的 path 参数，未命中任何带参数的
+// 路由时返回 nil。
+func RouteParams(req *http.Request) map[string]string {
+	params, _ := req.Context().Value(paramsKey{}).(map[string]string)
+	return params
+}
+
+// trieNode 是 router 的 radix trie 节点，按路径分段（以 "/" 切分）组织。
+// 静态分段放在 children 里；":name" 形式的分段作为 param 子节点，匹配
+// 任意一个分段并把值记录到参数表；"*name" 形式的分段作为 wildcard 子
+// 节点，吞掉路径剩余的全部内容，不能再往下细分。
+type trieNode struct {
+	children     map[string]*trieNode
+	paramChild   *trieNode
+	paramName    string
+	wildcard     *trieNode
+	wildcardName string
+	entry        *routeEntry
+}
+
+func newTrieNode() *trieNode {
+	return &trieNode{children: make(map[string]*trieNode)}
+}
+
+// routeEntry 保存一条路由命中后的转发目标、该路由专属中间件，以及
+// 转发前对 req.URL.Path 的改写规则。
+type routeEntry struct {
+	proxy          *ProxyServer
+	middleware     []Middleware
+	stripPrefix    string
+	addPrefix      string
+	rewritePattern *regexp.Regexp
+	rewriteReplace string
+}
+
+// rewrite 按固定顺序改写路径（与选项的传入顺序无关）：先 StripPrefix，再 AddPrefix，最后是
+// 正则替换，这样三种规则可以组合使用。
+func (e *routeEntry) rewrite(path string) string {
+	if e.stripPrefix != "" {
+		path = strings.TrimPrefix(path, e.stripPrefix)
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+	}
+	if e.addPrefix != "" {
+		path = e.addPrefix + path
+	}
+	if e.rewritePattern != nil {
+		path = e.rewritePattern.ReplaceAllString(path, e.rewriteReplace)
+	}
+	return path
+}
+
+// router 是支持最长前缀匹配、path 参数和基于 host 的分流的路由表。
+// hosts[""] 是默认（不区分 host）的 trie，只有在没有更具体的 host
+// trie 匹配时才会被使用。
+type router struct {
+	hosts map[string]*trieNode
+}
+
+func newRouter() *router {
+	return &router{hosts: map[string]*trieNode{"": newTrieNode()}}
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// add 把一条路由注册到指定 host（host 为空字符串表示对所有 host 生效）。
+func (r *router) add(host, path string, entry *routeEntry) {
+	root, ok := r.hosts[host]
+	if !ok {
+		root = newTrieNode()
+		r.hosts[host] = root
+	}
+
+	node := root
+	for _, seg := range splitPath(path) {
+		switch {
+		case strings.HasPrefix(seg, "*"):
+			if node.wildcard == nil {
+				node.wildcard = newTrieNode()
+				node.wildcardName = seg[1:]
+			}
+			node = node.wildcard
+		case strings.HasPrefix(seg, ":"):
+			if node.paramChild == nil {
+				node.paramChild = newTrieNode()
+				node.paramName = seg[1:]
+			}
+			node = node.paramChild
+		default:
+			child, ok := node.children[seg]
+			if !ok {
+				child = newTrieNode()
+				node.children[seg] = child
+			}
+			node = child
+		}
+	}
+	node.entry = entry
+}
+
+// match 先在给定 host 的 trie 里查找 path 的最长前缀匹配，host 没有
+// 专属 trie 或其中没有匹配时再退回默认 trie，返回命中的 routeEntry 及
+// 解析出的 path 参数。
+// "/" 作为根节点的 entry 只有在没有任何更具体的节点匹配时才会被当
+// 作兜底使用，而不是像线性扫描那样谁先匹配用谁。
+func (r *router) match(host, path string) (*routeEntry, map[string]string) {
+	if root, ok := r.hosts[host]; ok && host != "" {
+		if entry, params := matchTrie(root, path); entry != nil {
+			return entry, params
+		}
+	}
+	root := r.hosts[""]
+	if root == nil {
+		return nil, nil
+	}
+	return matchTrie(root, path)
+}
+
+// matchTrie 在单个 trie 里做最长前缀匹配。
+func matchTrie(root *trieNode, path string) (*routeEntry, map[string]string) {
+	node := root
+	var best *routeEntry
+	var bestParams map[string]string
+	params := make(map[string]string)
+
+	if node.entry != nil {
+		best, bestParams = node.entry, copyParams(params)
+	}
+
+	segs := splitPath(path)
+	for i, seg := range segs {
+		switch {
+		case node.children[seg] != nil:
+			node = node.children[seg]
+		case node.paramChild != nil:
+			params[node.paramName] = seg
+			node = node.paramChild
+		case node.wildcard != nil:
+			params[node.wildcardName] = strings.Join(segs[i:], "/")
+			node = node.wildcard
+			if node.entry != nil {
+				best, bestParams = node.entry, copyParams(params)
+			}
+			return best, bestParams
+		default:
+			return best, bestParams
+		}
+
+		if node.entry != nil {
+			best, bestParams = node.entry, copyParams(params)
+		}
+	}
+
+	return best, bestParams
+}
+
+func copyParams(params map[string]string) map[string]string {
+	if len(params) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(params))
+	for k, v := range params {
+		out[k] = v
+	}
+	return out
+}
+
+func withParams(req *http.Request, params map[string]string) *http.Request {
+	if params == nil {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), paramsKey{}, params))
+}
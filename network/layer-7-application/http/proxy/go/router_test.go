@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// linearScanRoutes 模拟引入 trie router 之前的线性扫描实现：请求来了
+// 就逐条检查前缀，谁先匹配上就用谁。旧实现遍历的是 map，这里改用按
+// 注册顺序排列的 (path, entry) 切片，让基准结果可重复。这里只是为了在
+// 基准测试里和新的 trie router 对比吞吐量，不是给生产代码用的。
+type linearScanRoutes struct {
+	paths   []string
+	entries []*routeEntry
+}
+
+func (l *linearScanRoutes) add(path string, entry *routeEntry) {
+	l.paths = append(l.paths, path)
+	l.entries = append(l.entries, entry)
+}
+
+func (l *linearScanRoutes) match(path string) *routeEntry {
+	for i, p := range l.paths {
+		if strings.HasPrefix(path, p) {
+			return l.entries[i]
+		}
+	}
+	return nil
+}
+
+// buildBenchRoutes 生成 n 条形如 "/svc42/api" 的路由路径，以及对应的
+// 请求路径（在路由前缀后面再加一段，模拟真实请求命中某个子路径）。
+func buildBenchRoutes(n int) (paths, lookups []string) {
+	paths = make([]string, n)
+	lookups = make([]string, n)
+	for i := 0; i < n; i++ {
+		paths[i] = fmt.Sprintf("/svc%d/api", i)
+		lookups[i] = fmt.Sprintf("/svc%d/api/detail", i)
+	}
+	return paths, lookups
+}
+
+// BenchmarkTrieRouter 在 1000 条路由规模下测量 router（trie）的查找吞吐量。
+func BenchmarkTrieRouter(b *testing.B) {
+	const n = 1000
+	paths, lookups := buildBenchRoutes(n)
+
+	r := newRouter()
+	for _, p := range paths {
+		r.add("", p, &routeEntry{})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.match("", lookups[i%n])
+	}
+}
+
+// BenchmarkLinearScan 在同样 1000 条路由规模下测量旧的线性扫描实现，
+// 用来和 BenchmarkTrieRouter 对比——线性扫描的耗时随路由数量线性增长，
+// trie 的耗时只取决于路径长度。
+func BenchmarkLinearScan(b *testing.B) {
+	const n = 1000
+	paths, lookups := buildBenchRoutes(n)
+
+	l := &linearScanRoutes{}
+	for _, p := range paths {
+		l.add(p, &routeEntry{})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.match(lookups[i%n])
+	}
+}
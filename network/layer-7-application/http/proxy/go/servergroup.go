@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// ServerGroup 统一管理一组 *http.Server：按添加顺序启动，监听一次
+// SIGINT/SIGTERM 后取消一个共享 context，再按启动的反序依次
+// Shutdown——这样代理服务器会先停止接收新连接，然后它的上游
+// （目标服务器）才会关闭，避免代理在关闭过程中把流量打到已经
+// 下线的上游。
+type ServerGroup struct {
+	servers      []*http.Server
+	names        []string
+	drainTimeout time.Duration
+}
+
+// NewServerGroup 创建一个 ServerGroup，drainTimeout 是每个 server
+// 等待在途请求完成的最长时间。
+func NewServerGroup(drainTimeout time.Duration) *ServerGroup {
+	return &ServerGroup{drainTimeout: drainTimeout}
+}
+
+// Add 登记一个 server，name 仅用于日志。登记顺序即启动顺序，
+// 关闭时按反序执行。
+func (g *ServerGroup) Add(name string, server *http.Server) {
+	g.servers = append(g.servers, server)
+	g.names = append(g.names, name)
+}
+
+// Run 启动所有 server 并阻塞，直到 ctx 被取消或收到 SIGINT/SIGTERM，
+// 然后按反序优雅关闭。返回关闭过程中遇到的最后一个错误（如果有）。
+func (g *ServerGroup) Run(ctx context.Context) error {
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	for i, server := range g.servers {
+		name, srv := g.names[i], server
+		go func() {
+			log.Printf("%s 启动于 %s", name, srv.Addr)
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("%s 错误: %v", name, err)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	log.Println("收到关闭信号，正在优雅关闭...")
+
+	var lastErr error
+	for i := len(g.servers) - 1; i >= 0; i-- {
+		name := g.names[i]
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), g.drainTimeout)
+		if err := g.servers[i].Shutdown(shutdownCtx); err != nil {
+			log.Printf("%s 关闭错误: %v", name, err)
+			lastErr = err
+		} else {
+			log.Printf("%s 已关闭", name)
+		}
+		cancel()
+	}
+
+	log.Println("所有服务器已关闭")
+	return lastErr
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"fmt"
+	"go/format"
 	"io"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/descriptorpb"
@@ -74,7 +78,150 @@ func debugMode() {
 	}
 }
 
+// typeInfo 记录一个消息/枚举的 Go 类型名（不带包名限定）、它是否为枚举，
+// 以及定义它的文件对应的 Go package 名/import 路径，用于跨文件解析
+// TYPE_MESSAGE/TYPE_ENUM 字段引用的 .proto 全限定名。
+type typeInfo struct {
+	goName     string
+	isEnum     bool
+	pkgName    string // 定义该类型的文件对应的 Go package 名
+	importPath string // 定义该类型的文件的 go_package import 路径，未设置时为空
+}
+
+// generator 持有一次生成过程中所需的共享上下文：请求携带的全部
+// proto 文件、解析后的命令行参数，以及按 proto 全限定名索引的类型表。
+// 把这些状态放在结构体里，而不是到处传参，是因为 generateMessage/
+// generateService 等函数需要递归地查表。currentFile/neededImports
+// 只在 generateFile 处理单个文件期间有效，用来在类型被跨包引用时
+// 记下需要补的 import。
+type generator struct {
+	req        *pluginpb.CodeGeneratorRequest
+	params     map[string]string
+	typesByFQN map[string]*typeInfo
+
+	currentFile   *descriptorpb.FileDescriptorProto
+	neededImports map[string]string // import 路径 -> 包名
+}
+
+// newGenerator 构造 generator 并建立跨文件的类型索引。
+func newGenerator(req *pluginpb.CodeGeneratorRequest) *generator {
+	g := &generator{
+		req:        req,
+		params:     parseParameter(req.GetParameter()),
+		typesByFQN: make(map[string]*typeInfo),
+	}
+	for _, f := range req.ProtoFile {
+		g.indexFile(f)
+	}
+	return g
+}
+
+// parseParameter 解析 protoc 通过 `--example_out=key=value,key2=value2:out_dir`
+// 传入的逗号分隔参数串，形如 "plugins=grpc,paths=source_relative"。
+func parseParameter(param string) map[string]string {
+	out := make(map[string]string)
+	if param == "" {
+		return out
+	}
+	for _, pair := range strings.Split(param, ",") {
+		if pair == "" {
+			continue
+		}
+		if k, v, ok := strings.Cut(pair, "="); ok {
+			out[k] = v
+		} else {
+			out[pair] = ""
+		}
+	}
+	return out
+}
+
+// wantsGRPC 判断是否要求生成 gRPC client/server 代码（`plugins=grpc`）。
+func (g *generator) wantsGRPC() bool {
+	plugins := g.params["plugins"]
+	for _, p := range strings.Split(plugins, "+") {
+		if p == "grpc" {
+			return true
+		}
+	}
+	return false
+}
+
+// indexFile 递归登记一个文件中的所有消息/枚举（含嵌套类型），
+// key 为 proto 全限定名（如 ".pkg.Outer.Inner"）。
+func (g *generator) indexFile(file *descriptorpb.FileDescriptorProto) {
+	pkg := file.GetPackage()
+	goPkgName := goPackageName(file)
+
+	importPath := goImportPath(file)
+
+	var walkMessage func(msg *descriptorpb.DescriptorProto, protoPrefix, goPrefix string)
+	walkMessage = func(msg *descriptorpb.DescriptorProto, protoPrefix, goPrefix string) {
+		protoFQN := protoPrefix + "." + msg.GetName()
+		goName := goPrefix + msg.GetName()
+		g.typesByFQN[protoFQN] = &typeInfo{goName: goName, pkgName: goPkgName, importPath: importPath}
+
+		for _, nestedEnum := range msg.EnumType {
+			nestedFQN := protoFQN + "." + nestedEnum.GetName()
+			g.typesByFQN[nestedFQN] = &typeInfo{goName: goName + "_" + nestedEnum.GetName(), isEnum: true, pkgName: goPkgName, importPath: importPath}
+		}
+
+		for _, nested := range msg.NestedType {
+			walkMessage(nested, protoFQN, goName+"_")
+		}
+	}
+
+	protoPrefix := ""
+	if pkg != "" {
+		protoPrefix = "." + pkg
+	}
+	for _, msg := range file.MessageType {
+		walkMessage(msg, protoPrefix, "")
+	}
+	for _, enum := range file.EnumType {
+		protoFQN := protoPrefix + "." + enum.GetName()
+		g.typesByFQN[protoFQN] = &typeInfo{goName: enum.GetName(), isEnum: true, pkgName: goPkgName, importPath: importPath}
+	}
+}
+
+// goImportPath 从 file.Options.GoPackage 里取出 import 路径部分
+// （"path/to/pkg;pkgname" 形式取 ";" 前半段，否则整串就是路径）；
+// 未设置 go_package 时返回空字符串，表示不知道真实 import 路径。
+func goImportPath(file *descriptorpb.FileDescriptorProto) string {
+	gp := file.GetOptions().GetGoPackage()
+	if gp == "" {
+		return ""
+	}
+	if path, _, ok := strings.Cut(gp, ";"); ok {
+		return path
+	}
+	return gp
+}
+
+// goPackageName 根据 file.Options.GoPackage（形如 "path/to/pkg;pkgname"
+// 或单纯的 "path/to/pkg"）推导出 Go package 名；未设置时退回到 proto package
+// 的最后一段，再退回到 "main"。
+func goPackageName(file *descriptorpb.FileDescriptorProto) string {
+	if gp := file.GetOptions().GetGoPackage(); gp != "" {
+		if _, name, ok := strings.Cut(gp, ";"); ok {
+			return name
+		}
+		if idx := strings.LastIndexByte(gp, '/'); idx >= 0 {
+			return gp[idx+1:]
+		}
+		return gp
+	}
+	if pkg := file.GetPackage(); pkg != "" {
+		if idx := strings.LastIndexByte(pkg, '.'); idx >= 0 {
+			return pkg[idx+1:]
+		}
+		return pkg
+	}
+	return "main"
+}
+
 func Generate(req *pluginpb.CodeGeneratorRequest) *pluginpb.CodeGeneratorResponse {
+	g := newGenerator(req)
 	resp := &pluginpb.CodeGeneratorResponse{}
 
 	for _, fileName := range req.FileToGenerate {
@@ -90,7 +237,7 @@ func Generate(req *pluginpb.CodeGeneratorRequest) *pluginpb.CodeGeneratorRespons
 			continue
 		}
 
-		content := generateFile(file)
+		content := g.generateFile(file)
 
 		resp.File = append(resp.File, &pluginpb.CodeGeneratorResponse_File{
 			Name:    proto.String(fileName + ".generated.go"),
@@ -103,43 +250,255 @@ func Generate(req *pluginpb.CodeGeneratorRequest) *pluginpb.CodeGeneratorRespons
 	return resp
 }
 
-func generateFile(file *descriptorpb.FileDescriptorProto) string {
-	var code string
+// generateFile 生成单个 .proto 文件对应的 Go 源码。消息/服务的代码先
+// 生成到 body 里，过程中跨包引用的类型会记录到 g.neededImports；等
+// body 生成完毕，已经知道这个文件实际需要哪些 import，再拼出文件头，
+// 这样 import 列表不会漏掉跨文件引用用到的包，也不会多出没用到的包。
+func (g *generator) generateFile(file *descriptorpb.FileDescriptorProto) string {
+	g.currentFile = file
+	g.neededImports = make(map[string]string)
+	defer func() {
+		g.currentFile = nil
+		g.neededImports = nil
+	}()
+
+	var body string
+	for _, enum := range file.EnumType {
+		body += g.generateEnum(enum, "")
+	}
+	for _, msg := range file.MessageType {
+		body += g.generateMessage(msg, "")
+	}
 
-	pkgName := file.GetPackage()
-	if pkgName == "" {
-		pkgName = "main"
+	needsGRPC := g.wantsGRPC() && len(file.Service) > 0
+	// 只有存在一元方法时，生成的代码才会用到 context/codes/status。
+	hasUnary := false
+	if needsGRPC {
+		for _, svc := range file.Service {
+			body += g.generateService(file, svc)
+			for _, m := range svc.Method {
+				if !m.GetClientStreaming() && !m.GetServerStreaming() {
+					hasUnary = true
+				}
+			}
+		}
 	}
-	code += "package " + pkgName + "\n\n"
 
-	for _, msg := range file.MessageType {
-		code += generateMessage(msg, "")
+	pkgName := goPackageName(file)
+	var header string
+	header += "package " + pkgName + "\n\n"
+
+	if needsGRPC || len(g.neededImports) > 0 {
+		header += "import (\n"
+		if hasUnary {
+			header += "\t\"context\"\n\n"
+		}
+		for _, path := range sortedImportPaths(g.neededImports) {
+			alias := g.neededImports[path]
+			if lastPathSegment(path) == alias {
+				header += "\t\"" + path + "\"\n"
+			} else {
+				header += "\t" + alias + " \"" + path + "\"\n"
+			}
+		}
+		if needsGRPC {
+			header += "\t\"google.golang.org/grpc\"\n"
+			if hasUnary {
+				header += "\t\"google.golang.org/grpc/codes\"\n"
+				header += "\t\"google.golang.org/grpc/status\"\n"
+			}
+		}
+		header += ")\n\n"
 	}
 
-	return code
+	code := header + body
+
+	formatted, err := format.Source([]byte(code))
+	if err != nil {
+		// 保留原始内容，方便调试格式化失败的具体原因
+		return code
+	}
+	return string(formatted)
 }
 
-func generateMessage(msg *descriptorpb.DescriptorProto, prefix string) string {
+// sortedImportPaths 返回 m 的 key（import 路径）按字典序排序后的切片，
+// 保证生成的 import 块每次顺序稳定。
+func sortedImportPaths(m map[string]string) []string {
+	paths := make([]string, 0, len(m))
+	for path := range m {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func lastPathSegment(path string) string {
+	if idx := strings.LastIndexByte(path, '/'); idx >= 0 {
+		return path[idx+1:]
+	}
+	return path
+}
+
+func (g *generator) generateMessage(msg *descriptorpb.DescriptorProto, prefix string) string {
 	msgName := prefix + msg.GetName()
 	code := "// Generated code for message: " + msgName + "\n"
 	code += "type " + msgName + " struct {\n"
 
 	for _, field := range msg.Field {
 		fieldName := camelCase(field.GetName())
-		fieldType := getGoType(field)
+		fieldType := g.getGoType(field)
 		code += "\t" + fieldName + " " + fieldType + " `json:\"" + field.GetName() + "\"`\n"
 	}
 
 	code += "}\n\n"
 
+	for _, nestedEnum := range msg.EnumType {
+		code += g.generateEnum(nestedEnum, msgName+"_")
+	}
+
 	for _, nested := range msg.NestedType {
-		code += generateMessage(nested, msgName+"_")
+		code += g.generateMessage(nested, msgName+"_")
 	}
 
 	return code
 }
 
-func getGoType(field *descriptorpb.FieldDescriptorProto) string {
+// generateEnum 为一个枚举生成 Go 类型定义（底层类型 int32）及其每个取值
+// 对应的常量。常量名按 protoc-gen-go 的惯例加上枚举名前缀
+// （EnumName_VALUE_NAME），避免同一文件里不同枚举的取值名冲突。
+func (g *generator) generateEnum(enum *descriptorpb.EnumDescriptorProto, prefix string) string {
+	enumName := prefix + enum.GetName()
+	code := "// Generated code for enum: " + enumName + "\n"
+	code += "type " + enumName + " int32\n\n"
+
+	code += "const (\n"
+	for _, v := range enum.Value {
+		code += "\t" + enumName + "_" + v.GetName() + " " + enumName + " = " + strconv.Itoa(int(v.GetNumber())) + "\n"
+	}
+	code += ")\n\n"
+
+	return code
+}
+
+// generateService 为单个 ServiceDescriptorProto 生成 client/server 接口、
+// 默认的 unsupported server 实现以及注册函数，风格上对应
+// protoc-gen-go-grpc 产出的最小子集。流式 RPC 暂不生成——本插件不产出
+// Xxx_MethodNameClient/Server 这类流式辅助类型，生成流式方法签名只会
+// 引用不存在的类型，所以这里直接跳过，保持输出始终可编译；跳过的每个
+// 方法都会在接口里留一行 TODO 注释，而不是悄无声息地从接口里消失。
+func (g *generator) generateService(file *descriptorpb.FileDescriptorProto, svc *descriptorpb.ServiceDescriptorProto) string {
+	svcName := svc.GetName()
+	var code string
+
+	// Client 接口（不含流式方法，见上面的说明）
+	code += "type " + svcName + "Client interface {\n"
+	for _, m := range svc.Method {
+		if m.GetClientStreaming() || m.GetServerStreaming() {
+			code += "\t// TODO: streaming not supported for " + m.GetName() + "\n"
+			continue
+		}
+		code += "\t" + g.clientMethodSignature(m) + "\n"
+	}
+	code += "}\n\n"
+
+	// Server 接口（不含流式方法，见上面的说明）
+	code += "type " + svcName + "Server interface {\n"
+	for _, m := range svc.Method {
+		if m.GetClientStreaming() || m.GetServerStreaming() {
+			code += "\t// TODO: streaming not supported for " + m.GetName() + "\n"
+			continue
+		}
+		code += "\t" + g.serverMethodSignature(m) + "\n"
+	}
+	code += "}\n\n"
+
+	// 未实现的默认 server，镶嵌后可以只实现关心的方法
+	code += "type Unimplemented" + svcName + "Server struct{}\n\n"
+	for _, m := range svc.Method {
+		if m.GetClientStreaming() || m.GetServerStreaming() {
+			continue
+		}
+		inType := g.resolveTypeName(m.GetInputType())
+		outType := g.resolveTypeName(m.GetOutputType())
+		code += "func (Unimplemented" + svcName + "Server) " + m.GetName() + "(context.Context, *" + inType + ") (*" + outType + ", error) {\n"
+		code += "\treturn nil, status.Errorf(codes.Unimplemented, \"method " + m.GetName() + " not implemented\")\n"
+		code += "}\n\n"
+	}
+
+	// 注册函数
+	code += "func Register" + svcName + "Server(s grpc.ServiceRegistrar, srv " + svcName + "Server) {\n"
+	code += "\ts.RegisterService(&_" + svcName + "_serviceDesc, srv)\n"
+	code += "}\n\n"
+
+	code += g.generateServiceDesc(file, svc)
+
+	return code
+}
+
+// generateServiceDesc 生成 grpc.ServiceDesc 及一元方法的 handler 函数，
+// 供 RegisterXxxServer 在服务器端注册使用。流式方法目前不生成（见
+// generateService 的说明），所以 Streams 始终为空。
+func (g *generator) generateServiceDesc(file *descriptorpb.FileDescriptorProto, svc *descriptorpb.ServiceDescriptorProto) string {
+	svcName := svc.GetName()
+	var code string
+
+	for _, m := range svc.Method {
+		if m.GetClientStreaming() || m.GetServerStreaming() {
+			continue
+		}
+		inType := g.resolveTypeName(m.GetInputType())
+		code += "func _" + svcName + "_" + m.GetName() + "_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {\n"
+		code += "\tin := new(" + inType + ")\n"
+		code += "\tif err := dec(in); err != nil {\n\t\treturn nil, err\n\t}\n"
+		code += "\tif interceptor == nil {\n"
+		code += "\t\treturn srv.(" + svcName + "Server)." + m.GetName() + "(ctx, in)\n"
+		code += "\t}\n"
+		code += "\tinfo := &grpc.UnaryServerInfo{Server: srv, FullMethod: \"/" + svc.GetName() + "/" + m.GetName() + "\"}\n"
+		code += "\thandler := func(ctx context.Context, req interface{}) (interface{}, error) {\n"
+		code += "\t\treturn srv.(" + svcName + "Server)." + m.GetName() + "(ctx, req.(*" + inType + "))\n"
+		code += "\t}\n"
+		code += "\treturn interceptor(ctx, in, info, handler)\n"
+		code += "}\n\n"
+	}
+
+	code += "var _" + svcName + "_serviceDesc = grpc.ServiceDesc{\n"
+	code += "\tServiceName: \"" + svc.GetName() + "\",\n"
+	code += "\tHandlerType: (*" + svcName + "Server)(nil),\n"
+	code += "\tMethods: []grpc.MethodDesc{\n"
+	for _, m := range svc.Method {
+		if m.GetClientStreaming() || m.GetServerStreaming() {
+			continue
+		}
+		code += "\t\t{\n"
+		code += "\t\t\tMethodName: \"" + m.GetName() + "\",\n"
+		code += "\t\t\tHandler:    _" + svcName + "_" + m.GetName() + "_Handler,\n"
+		code += "\t\t},\n"
+	}
+	code += "\t},\n"
+	code += "\tStreams:  []grpc.StreamDesc{},\n"
+	code += "\tMetadata: \"" + file.GetName() + "\",\n"
+	code += "}\n\n"
+
+	return code
+}
+
+// clientMethodSignature 生成 XxxClient 接口里单个一元方法的签名。
+// 调用方只会对非流式方法调用这个函数，见 generateService。
+func (g *generator) clientMethodSignature(m *descriptorpb.MethodDescriptorProto) string {
+	inType := g.resolveTypeName(m.GetInputType())
+	outType := g.resolveTypeName(m.GetOutputType())
+	return m.GetName() + "(ctx context.Context, in *" + inType + ", opts ...grpc.CallOption) (*" + outType + ", error)"
+}
+
+// serverMethodSignature 生成 XxxServer 接口里单个一元方法的签名。
+// 调用方只会对非流式方法调用这个函数，见 generateService。
+func (g *generator) serverMethodSignature(m *descriptorpb.MethodDescriptorProto) string {
+	inType := g.resolveTypeName(m.GetInputType())
+	outType := g.resolveTypeName(m.GetOutputType())
+	return m.GetName() + "(context.Context, *" + inType + ") (*" + outType + ", error)"
+}
+
+func (g *generator) getGoType(field *descriptorpb.FieldDescriptorProto) string {
 	isRepeated := field.GetLabel() == descriptorpb.FieldDescriptorProto_LABEL_REPEATED
 
 	var baseType string
@@ -163,9 +522,9 @@ func getGoType(field *descriptorpb.FieldDescriptorProto) string {
 	case descriptorpb.FieldDescriptorProto_TYPE_BYTES:
 		baseType = "[]byte"
 	case descriptorpb.FieldDescriptorProto_TYPE_MESSAGE:
-		baseType = "*" + getTypeName(field.GetTypeName())
+		baseType = "*" + g.resolveTypeName(field.GetTypeName())
 	case descriptorpb.FieldDescriptorProto_TYPE_ENUM:
-		baseType = getTypeName(field.GetTypeName())
+		baseType = g.resolveTypeName(field.GetTypeName())
 	default:
 		baseType = "interface{}"
 	}
@@ -173,9 +532,38 @@ func getGoType(field *descriptorpb.FieldDescriptorProto) string {
 	if isRepeated {
 		return "[]" + baseType
 	}
+
+	// proto3 optional 标量字段要和 message 字段一样能区分"未设置"，
+	// 所以用指针承载；message/repeated 已经天然可为 nil，不需要再包一层。
+	if field.GetProto3Optional() && field.GetType() != descriptorpb.FieldDescriptorProto_TYPE_MESSAGE {
+		return "*" + baseType
+	}
+
 	return baseType
 }
 
+// resolveTypeName 把 .proto 全限定类型名（如 ".pkg.Outer.Inner"）解析成
+// 对应的 Go 类型名。能在跨文件类型表里查到就用查到的结果：如果定义该
+// 类型的文件和当前正在生成的文件是同一个 Go package，直接用裸类型名；
+// 否则加上包名限定（"pkg.Type"），并把对应的 import 路径记到
+// g.neededImports 里，好让 generateFile 在文件头里补上这个 import。
+// 查不到时退回旧的"取最后一段"启发式，保证未知输入也能产出可读的名字。
+func (g *generator) resolveTypeName(fullName string) string {
+	info, ok := g.typesByFQN[fullName]
+	if !ok {
+		return getTypeName(fullName)
+	}
+
+	if g.currentFile == nil || info.pkgName == goPackageName(g.currentFile) {
+		return info.goName
+	}
+
+	if info.importPath != "" {
+		g.neededImports[info.importPath] = info.pkgName
+	}
+	return info.pkgName + "." + info.goName
+}
+
 func getTypeName(fullName string) string {
 	for i := len(fullName) - 1; i >= 0; i-- {
 		if fullName[i] == '.' {